@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// incrementalShardSize is the number of items per shard; shards are the
+// unit of content-addressed reuse between snapshots.
+const incrementalShardSize = 4096
+
+// Manifest lists a snapshot's shards in order by content hash, plus the
+// maps needed to rebuild a Store. Unchanged shards between two manifests
+// share the same hash and therefore the same blob file on disk.
+type Manifest struct {
+	Shards []string
+	Maps   ModelMaps
+	Seq    uint64
+}
+
+func blobPath(dirname, hash string) string {
+	return filepath.Join(dirname, "blobs", hash[:2], hash)
+}
+
+// readManifestShards reads and verifies the manifest at path (without
+// falling back itself) and returns just its shard hashes, so gcBlobs can
+// fold manifest.json.bak's referenced shards into its keep-set.
+func readManifestShards(path string) ([]string, error) {
+	data, _, err := readSnapshotFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	return manifest.Shards, nil
+}
+
+// saveAsIncremental splits ITEMS into fixed-size shards, gob+gzips each
+// independently, and names the blob by the SHA-256 of its compressed
+// bytes. A shard whose blob already exists on disk (i.e. its contents
+// haven't changed since the last snapshot) is left alone, so only shards
+// that actually changed cause any disk writes.
+func saveAsIncremental(dirname string) (int64, error) {
+	store := makeStore()
+	if err := os.MkdirAll(filepath.Join(dirname, "blobs"), 0777); err != nil {
+		return 0, err
+	}
+
+	manifest := Manifest{Maps: store.Maps, Seq: store.Seq}
+	var total int64
+
+	for i := 0; i < len(store.Items); i += incrementalShardSize {
+		end := i + incrementalShardSize
+		if end > len(store.Items) {
+			end = len(store.Items)
+		}
+		shard := store.Items[i:end]
+
+		buf := bytes.Buffer{}
+		if err := gob.NewEncoder(&buf).Encode(shard); err != nil {
+			return 0, err
+		}
+		compressed := CompressWith(CODECS["gzip"], buf.Bytes())
+		sum := sha256.Sum256(compressed)
+		hash := hex.EncodeToString(sum[:])
+
+		path := blobPath(dirname, hash)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				return 0, err
+			}
+			if err := WriteToFile(compressed, path); err != nil {
+				return 0, err
+			}
+			total += int64(len(compressed))
+		}
+		manifest.Shards = append(manifest.Shards, hash)
+	}
+
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return 0, err
+	}
+	if err := WriteSnapshotFile(manifestData, codecNone, filepath.Join(dirname, "manifest.json")); err != nil {
+		return 0, err
+	}
+	finishSnapshot(store)
+
+	if err := gcBlobs(dirname, manifest); err != nil {
+		fmt.Println("incremental: blob GC failed", err)
+	}
+
+	total += int64(len(manifestData))
+	return total, nil
+}
+
+// gcBlobs removes every blob under dirname/blobs that isn't referenced by
+// manifest or by manifest.json.bak (the previous manifest, kept around by
+// WriteSnapshotFile as the fallback ReadSnapshotFile/loadAsIncremental use
+// when the primary manifest fails verification). Keeping both generations'
+// shards alive means that fallback can actually still find its blobs;
+// keying GC off only the just-written manifest would delete any blob a
+// changed shard orphaned before the new manifest had a chance to prove
+// itself durable.
+func gcBlobs(dirname string, manifest Manifest) error {
+	keep := make(map[string]bool, len(manifest.Shards))
+	for _, hash := range manifest.Shards {
+		keep[hash] = true
+	}
+	if prev, err := readManifestShards(filepath.Join(dirname, "manifest.json.bak")); err == nil {
+		for _, hash := range prev {
+			keep[hash] = true
+		}
+	}
+
+	blobsDir := filepath.Join(dirname, "blobs")
+	shardDirs, err := ioutil.ReadDir(blobsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, shardDir := range shardDirs {
+		shardPath := filepath.Join(blobsDir, shardDir.Name())
+		blobs, err := ioutil.ReadDir(shardPath)
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			if keep[blob.Name()] {
+				continue
+			}
+			if err := os.Remove(filepath.Join(shardPath, blob.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadAsIncremental reads the manifest, verifies every blob's hash, and
+// reassembles ITEMS in shard order.
+func loadAsIncremental(dirname string) (int, error) {
+	data, _, err := ReadSnapshotFile(filepath.Join(dirname, "manifest.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return 0, err
+	}
+
+	var items Items
+	for _, hash := range manifest.Shards {
+		compressed, err := ioutil.ReadFile(blobPath(dirname, hash))
+		if err != nil {
+			return 0, err
+		}
+
+		sum := sha256.Sum256(compressed)
+		if hex.EncodeToString(sum[:]) != hash {
+			return 0, fmt.Errorf("incremental: blob %s failed hash verification", hash)
+		}
+
+		raw := DecompressWith(CODECS["gzip"], compressed)
+		var shard Items
+		if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&shard); err != nil {
+			return 0, err
+		}
+		items = append(items, shard...)
+	}
+
+	restoreStore(Store{Items: items, Maps: manifest.Maps, Seq: manifest.Seq})
+	return len(ITEMS), nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// snapshotMagic identifies a file written by WriteSnapshotFile.
+var snapshotMagic = [4]byte{'L', 'M', 'D', 'B'}
+
+const snapshotVersion uint16 = 1
+
+// codec ids recorded in the snapshot header, independent of CODECS'
+// string names so the on-disk format doesn't depend on map iteration.
+const (
+	codecNone uint8 = iota
+	codecGzip
+	codecZstd
+)
+
+// header layout: magic(4) + version(2) + codec(1) + flags(4) + length(8) + crc(4)
+const snapshotHeaderSize = 4 + 2 + 1 + 4 + 8 + 4
+
+// ErrCorruptSnapshot is returned when a snapshot file fails header, length,
+// or checksum validation, so loadAtStart can report it instead of a
+// truncated or bit-flipped file silently producing a partial ITEMS deep
+// inside gob/json decoding.
+type ErrCorruptSnapshot struct {
+	Filename string
+	Reason   string
+}
+
+func (e *ErrCorruptSnapshot) Error() string {
+	return fmt.Sprintf("corrupt snapshot %s: %s", e.Filename, e.Reason)
+}
+
+// WriteSnapshotFile wraps payload in a fixed header (magic, version, codec
+// id, flags, length, CRC32C) and writes it atomically. Whatever was
+// previously at filename is kept as filename.bak first, so a snapshot
+// that fails verification later still has a known-good fallback.
+func WriteSnapshotFile(payload []byte, codecId uint8, filename string) error {
+	if _, err := os.Stat(filename); err == nil {
+		if err := os.Rename(filename, filename+".bak"); err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, snapshotHeaderSize)
+	copy(header[0:4], snapshotMagic[:])
+	binary.BigEndian.PutUint16(header[4:6], snapshotVersion)
+	header[6] = codecId
+	binary.BigEndian.PutUint32(header[7:11], 0) // flags, reserved
+	binary.BigEndian.PutUint64(header[11:19], uint64(len(payload)))
+	binary.BigEndian.PutUint32(header[19:23], crc32.Checksum(payload, crc32cTable))
+
+	return WriteToFile(append(header, payload...), filename)
+}
+
+// ReadSnapshotFile validates and strips the header written by
+// WriteSnapshotFile, falling back to filename.bak if the primary file is
+// missing or fails verification.
+func ReadSnapshotFile(filename string) ([]byte, uint8, error) {
+	payload, codecId, err := readSnapshotFile(filename)
+	if err == nil {
+		return payload, codecId, nil
+	}
+
+	bak := filename + ".bak"
+	if _, statErr := os.Stat(bak); statErr == nil {
+		fmt.Println("primary snapshot failed verification, falling back to", bak, "reason:", err)
+		return readSnapshotFile(bak)
+	}
+	return nil, 0, err
+}
+
+func readSnapshotFile(filename string) ([]byte, uint8, error) {
+	data, err := ReadFromFile(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < snapshotHeaderSize {
+		return nil, 0, &ErrCorruptSnapshot{Filename: filename, Reason: "file shorter than header"}
+	}
+
+	if string(data[0:4]) != string(snapshotMagic[:]) {
+		return nil, 0, &ErrCorruptSnapshot{Filename: filename, Reason: "bad magic"}
+	}
+	if version := binary.BigEndian.Uint16(data[4:6]); version != snapshotVersion {
+		return nil, 0, &ErrCorruptSnapshot{Filename: filename, Reason: fmt.Sprintf("unsupported version %d", version)}
+	}
+	codecId := data[6]
+	payloadLen := binary.BigEndian.Uint64(data[11:19])
+	wantCRC := binary.BigEndian.Uint32(data[19:23])
+
+	payload := data[snapshotHeaderSize:]
+	if uint64(len(payload)) != payloadLen {
+		return nil, 0, &ErrCorruptSnapshot{Filename: filename, Reason: "payload length mismatch"}
+	}
+	if crc32.Checksum(payload, crc32cTable) != wantCRC {
+		return nil, 0, &ErrCorruptSnapshot{Filename: filename, Reason: "CRC mismatch"}
+	}
+	return payload, codecId, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replAckEvery is how many records a replica acknowledges at a time, so
+// the leader can prune WAL segments no connected follower still needs.
+const replAckEvery = 1000
+
+// replHeartbeatInterval is how often the leader pings an idle connection
+// (no new WAL records to send) so a dead follower is noticed promptly.
+const replHeartbeatInterval = 5 * time.Second
+
+// replMsgKind tags what a replFrame carries, so a replica can tell a WAL
+// record apart from a plain heartbeat.
+type replMsgKind uint8
+
+const (
+	replMsgRecord replMsgKind = iota
+	replMsgHeartbeat
+)
+
+type replFrame struct {
+	Kind   replMsgKind
+	Record WalRecord
+}
+
+type replAck struct {
+	Seq uint64
+}
+
+var replicaAcks = struct {
+	mu     sync.Mutex
+	byPeer map[string]uint64
+}{byPeer: make(map[string]uint64)}
+
+func recordReplicaAck(peer string, seq uint64) {
+	replicaAcks.mu.Lock()
+	defer replicaAcks.mu.Unlock()
+	replicaAcks.byPeer[peer] = seq
+}
+
+func unregisterReplica(peer string) {
+	replicaAcks.mu.Lock()
+	defer replicaAcks.mu.Unlock()
+	delete(replicaAcks.byPeer, peer)
+}
+
+// MinReplicaAck returns the lowest sequence number acknowledged by any
+// connected replica, so the leader never prunes a WAL segment a follower
+// hasn't applied yet. ok is false when there are no connected replicas.
+func MinReplicaAck() (uint64, bool) {
+	replicaAcks.mu.Lock()
+	defer replicaAcks.mu.Unlock()
+
+	if len(replicaAcks.byPeer) == 0 {
+		return 0, false
+	}
+	min := uint64(0)
+	first := true
+	for _, seq := range replicaAcks.byPeer {
+		if first || seq < min {
+			min = seq
+			first = false
+		}
+	}
+	return min, true
+}
+
+// StartReplicationServer accepts replica connections on addr. Each
+// connection sends "SYNC <lastSeq>\n"; the leader full-syncs (streaming
+// the current snapshot, same format as saveStreaming) when lastSeq falls
+// outside the WAL's retention, then keeps the connection open and tails
+// new WAL records as they're appended (woken via WAL.NotifyChan, falling
+// back to a heartbeat on idle), pruning only once every connected
+// replica has acked past them.
+func StartReplicationServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("replication: listening on", addr)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				fmt.Println("replication: accept failed", err)
+				continue
+			}
+			go serveReplica(conn)
+		}
+	}()
+	return nil
+}
+
+func serveReplica(conn net.Conn) {
+	peer := conn.RemoteAddr().String()
+	defer conn.Close()
+	defer unregisterReplica(peer)
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("replication: bad handshake from", peer, err)
+		return
+	}
+
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) != 2 || fields[0] != "SYNC" {
+		fmt.Println("replication: expected SYNC <lastSeq> from", peer, "got", line)
+		return
+	}
+	lastSeq, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		fmt.Println("replication: bad lastSeq from", peer, fields[1])
+		return
+	}
+	recordReplicaAck(peer, lastSeq)
+
+	oldest, err := walInstance.OldestSeq()
+	if err != nil {
+		fmt.Println("replication: could not inspect WAL for", peer, err)
+		return
+	}
+
+	enc := gob.NewEncoder(conn)
+	fullSync := oldest > 0 && lastSeq < oldest-1
+	if err := enc.Encode(fullSync); err != nil {
+		fmt.Println("replication: handshake reply to", peer, "failed", err)
+		return
+	}
+	if fullSync {
+		seq, err := encodeStreamPayload(enc)
+		if err != nil {
+			fmt.Println("replication: full sync to", peer, "failed", err)
+			return
+		}
+		lastSeq = seq
+		// The replica's real floor is now the snapshot's seq, not the
+		// pre-sync value recorded above — update it immediately instead
+		// of waiting for a WAL record to flow through and refresh it,
+		// otherwise MinReplicaAck stays pinned near 0 (blocking pruning)
+		// for as long as the leader stays idle after this full sync.
+		recordReplicaAck(peer, lastSeq)
+	}
+
+	ackDec := gob.NewDecoder(conn)
+	go func() {
+		for {
+			var ack replAck
+			if err := ackDec.Decode(&ack); err != nil {
+				return
+			}
+			recordReplicaAck(peer, ack.Seq)
+		}
+	}()
+
+	sent := 0
+	for {
+		// Grab the wake-up channel before scanning, so an append that
+		// lands mid-scan still triggers the next wait instead of being
+		// missed between "nothing new" and "go to sleep".
+		woken := walInstance.NotifyChan()
+
+		caughtUpTo := lastSeq
+		err := walInstance.Replay(lastSeq, func(rec WalRecord) error {
+			if err := enc.Encode(replFrame{Kind: replMsgRecord, Record: rec}); err != nil {
+				return err
+			}
+			caughtUpTo = rec.Seq
+			sent++
+			if sent%replAckEvery == 0 {
+				return enc.Encode(replFrame{Kind: replMsgHeartbeat})
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Println("replication: tailing WAL to", peer, "failed", err)
+			return
+		}
+
+		if caughtUpTo != lastSeq {
+			lastSeq = caughtUpTo
+			continue
+		}
+
+		select {
+		case <-woken:
+		case <-time.After(replHeartbeatInterval):
+			if err := enc.Encode(replFrame{Kind: replMsgHeartbeat}); err != nil {
+				fmt.Println("replication: heartbeat to", peer, "failed", err)
+				return
+			}
+		}
+	}
+}
+
+// replReconnectDelay is how long a replica waits before redialing the
+// leader after a dropped or corrupt connection.
+const replReconnectDelay = 2 * time.Second
+
+// StartReplica connects to leaderAddr, requests everything after the
+// last record it has applied, and feeds incoming records through the
+// same code path ItemChanWorker uses so indexes stay consistent. The
+// connection is kept alive for the life of the process: if it drops, or
+// a full-sync stream turns out corrupt, StartReplica reconnects instead
+// of leaving a dead connection and a possibly half-applied ITEMS behind.
+func StartReplica(leaderAddr string) error {
+	conn, lastSeq, err := dialReplica(leaderAddr)
+	if err != nil {
+		return err
+	}
+
+	go replicaConnLoop(leaderAddr, conn, lastSeq)
+	return nil
+}
+
+func dialReplica(leaderAddr string) (net.Conn, uint64, error) {
+	conn, err := net.Dial("tcp", leaderAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lastSeq := walInstance.Seq()
+	if _, err := fmt.Fprintf(conn, "SYNC %d\n", lastSeq); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	return conn, lastSeq, nil
+}
+
+func replicaConnLoop(leaderAddr string, conn net.Conn, lastSeq uint64) {
+	for {
+		if err := replicaLoop(conn, lastSeq); err != nil {
+			fmt.Println("replica: connection to", leaderAddr, "lost:", err)
+		}
+
+		var err error
+		for {
+			time.Sleep(replReconnectDelay)
+			conn, lastSeq, err = dialReplica(leaderAddr)
+			if err == nil {
+				break
+			}
+			fmt.Println("replica: reconnect to", leaderAddr, "failed", err)
+		}
+	}
+}
+
+func replicaLoop(conn net.Conn, lastSeq uint64) error {
+	defer conn.Close()
+
+	dec := gob.NewDecoder(conn)
+
+	var fullSync bool
+	if err := dec.Decode(&fullSync); err != nil {
+		return fmt.Errorf("handshake reply failed: %w", err)
+	}
+	if fullSync {
+		meta, err := decodeStreamPayload(dec)
+		if err != nil {
+			// decodeStreamPayload may have already populated ITEMS
+			// partway through before failing; a half-applied store is
+			// worse than an empty one, and the reconnect above will
+			// request a fresh full sync from the leader.
+			ITEMS = nil
+			return fmt.Errorf("full sync decode failed: %w", err)
+		}
+		// The snapshot covers everything up to meta.Seq; jump lastSeq
+		// there instead of leaving it at the pre-sync handshake value,
+		// so acks and a future reconnect's SYNC reflect where this
+		// replica actually is.
+		lastSeq = meta.Seq
+		walInstance.AdvanceSeq(meta.Seq)
+	}
+
+	ackEnc := gob.NewEncoder(conn)
+	applied := 0
+	for {
+		var frame replFrame
+		if err := dec.Decode(&frame); err != nil {
+			return fmt.Errorf("connection to leader lost: %w", err)
+		}
+
+		switch frame.Kind {
+		case replMsgRecord:
+			if err := applyWalRecord(frame.Record); err != nil {
+				fmt.Println("replica: failed to apply record", err)
+				continue
+			}
+			if err := walInstance.AppendRecord(frame.Record); err != nil {
+				fmt.Println("replica: failed to persist record", err)
+			}
+			lastSeq = frame.Record.Seq
+			applied++
+			if applied%replAckEvery == 0 {
+				if err := ackEnc.Encode(replAck{Seq: lastSeq}); err != nil {
+					fmt.Println("replica: ack failed", err)
+				}
+			}
+		case replMsgHeartbeat:
+			if err := ackEnc.Encode(replAck{Seq: lastSeq}); err != nil {
+				fmt.Println("replica: ack failed", err)
+			}
+		}
+	}
+}
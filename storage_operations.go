@@ -2,9 +2,9 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -15,6 +15,9 @@ import (
 type Store struct {
 	Items Items
 	Maps  ModelMaps
+	// Seq is the WAL sequence number committed as of this snapshot; on
+	// load, only WAL records with a higher Seq need to be replayed.
+	Seq uint64
 }
 
 type storageFunc func(string) (int64, error)
@@ -30,26 +33,32 @@ func init() {
 	STORAGEFUNCS = make(storageFuncs)
 	STORAGEFUNCS["bytes"] = saveAsBytes // currently default
 	STORAGEFUNCS["bytesz"] = saveAsBytesCompressed
+	STORAGEFUNCS["bytesz2"] = saveAsBytesZstd
 	STORAGEFUNCS["json"] = saveAsJsonZipped
+	STORAGEFUNCS["incremental"] = saveAsIncremental
+	STORAGEFUNCS["stream"] = saveAsBytesStreaming
+	STORAGEFUNCS["streamz"] = saveAsBytesStreamingCompressed
 
 	RETRIEVEFUNCS = make(retrieveFuncs)
 	RETRIEVEFUNCS["bytes"] = loadAsBytes // currently default
 	RETRIEVEFUNCS["bytesz"] = loadAsBytesCompressed
+	RETRIEVEFUNCS["bytesz2"] = loadAsBytesZstd
 	RETRIEVEFUNCS["json"] = loadAsJsonZipped
+	RETRIEVEFUNCS["incremental"] = loadAsIncremental
+	RETRIEVEFUNCS["stream"] = loadAsBytesStreaming
+	RETRIEVEFUNCS["streamz"] = loadAsBytesStreamingCompressed
 }
 
 func saveAsJsonZipped(filename string) (int64, error) {
 	store := makeStore()
-	var b bytes.Buffer
-	writer := gzip.NewWriter(&b)
-	itemJSON, _ := json.Marshal(store)
-	writer.Write(itemJSON)
-	writer.Flush()
-	writer.Close()
-	err := ioutil.WriteFile(filename, b.Bytes(), 0666)
+	itemJSON, err := json.Marshal(store)
 	if err != nil {
 		return 0, err
 	}
+	if err := WriteSnapshotFile(Compress(itemJSON), codecGzip, filename); err != nil {
+		return 0, err
+	}
+	finishSnapshot(store)
 	fi, err := os.Stat(filename)
 	if err != nil {
 		return 0, err
@@ -60,7 +69,7 @@ func saveAsJsonZipped(filename string) (int64, error) {
 }
 
 func makeStore() Store {
-	return Store{ITEMS, CreateMapstore()}
+	return Store{ITEMS, CreateMapstore(), walInstance.Seq()}
 }
 
 func restoreStore(store Store) {
@@ -68,12 +77,33 @@ func restoreStore(store Store) {
 	LoadMapstore(store.Maps)
 	// rebuild indexes
 	ITEMS.FillIndexes()
+
+	if err := walInstance.Replay(store.Seq, applyWalRecord); err != nil {
+		fmt.Println("Unable to replay WAL", err)
+	}
+}
+
+// finishSnapshot prunes WAL segments that are now fully covered by the
+// snapshot just written, so the log doesn't grow forever. It never prunes
+// past what the slowest connected replica has acknowledged, so a follower
+// that's behind doesn't lose records it still needs to catch up on.
+func finishSnapshot(store Store) {
+	upTo := store.Seq
+	if floor, ok := MinReplicaAck(); ok && floor < upTo {
+		upTo = floor
+	}
+	if err := walInstance.Prune(upTo); err != nil {
+		fmt.Println("Unable to prune WAL", err)
+	}
 }
 
 func saveAsBytes(filename string) (int64, error) {
 	store := makeStore()
 	data := EncodeItems(store)
-	WriteToFile(data, filename)
+	if err := WriteSnapshotFile(data, codecNone, filename); err != nil {
+		return 0, err
+	}
+	finishSnapshot(store)
 	fi, err := os.Stat(filename)
 	if err != nil {
 		return 0, err
@@ -87,7 +117,10 @@ func saveAsBytesCompressed(filename string) (int64, error) {
 	store := makeStore()
 	data := EncodeItems(store)
 	data = Compress(data)
-	WriteToFile(data, filename)
+	if err := WriteSnapshotFile(data, codecGzip, filename); err != nil {
+		return 0, err
+	}
+	finishSnapshot(store)
 	fi, err := os.Stat(filename)
 	if err != nil {
 		return 0, err
@@ -108,97 +141,102 @@ func EncodeItems(s Store) []byte {
 }
 
 func Compress(s []byte) []byte {
-	zipbuf := bytes.Buffer{}
-	zipped := gzip.NewWriter(&zipbuf)
-	zipped.Write(s)
-	zipped.Close()
-	return zipbuf.Bytes()
+	return CompressWith(CODECS["gzip"], s)
 }
 
 func Decompress(s []byte) []byte {
-	//TODO check empty
-	reader, _ := gzip.NewReader(bytes.NewReader(s))
-	data, err := ioutil.ReadAll(reader)
-	if err != nil {
-		fmt.Println("Unable to Decompress", err)
-	}
-	reader.Close()
-	return data
+	return DecompressWith(CODECS["gzip"], s)
 }
 
-func DecodeToStore(s []byte) Store {
+func DecodeToStore(s []byte) (Store, error) {
 	store := Store{}
 	decoder := gob.NewDecoder(bytes.NewReader(s))
-	err := decoder.Decode(&store)
-	if err != nil {
-		fmt.Println("Unable to Decode", err)
+	if err := decoder.Decode(&store); err != nil {
+		return store, fmt.Errorf("decode store: %w", err)
 	}
-	return store
+	return store, nil
 }
 
-func WriteToFile(s []byte, filename string) {
-	f, err := os.Create(filename)
+// WriteToFile writes s to filename via a temp file + fsync + rename, so a
+// crash mid-save can never leave filename truncated or half-written. The
+// caller must check the returned error: a snapshot write failure must not
+// be treated as success, since callers like finishSnapshot prune the WAL
+// right after and would otherwise delete the only copy of data that never
+// actually made it to disk.
+func WriteToFile(s []byte, filename string) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
-		fmt.Println("Unable to WriteToFile", err)
+		return fmt.Errorf("WriteToFile: %w", err)
+	}
+	if _, err := f.Write(s); err != nil {
+		f.Close()
+		return fmt.Errorf("WriteToFile: %w", err)
 	}
-	f.Write(s)
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("WriteToFile: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("WriteToFile: %w", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("WriteToFile: %w", err)
+	}
+	return nil
 }
 
-func ReadFromFile(filename string) []byte {
+func ReadFromFile(filename string) ([]byte, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		fmt.Println("Unable to ReadFromFile", err)
+		return nil, err
 	}
+	defer f.Close()
+
 	data, err := ioutil.ReadAll(f)
 	if err != nil {
-		fmt.Println("Unable to ReadFromFile1", err)
+		return nil, err
 	}
-	return data
+	return data, nil
 }
 
 func loadAsBytes(filename string) (int, error) {
-	d := ReadFromFile(filename)
-	store := DecodeToStore(d)
+	payload, _, err := ReadSnapshotFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	store, err := DecodeToStore(payload)
+	if err != nil {
+		return 0, err
+	}
 	restoreStore(store)
 	return len(ITEMS), nil
 }
 
 func loadAsBytesCompressed(filename string) (int, error) {
-	d := ReadFromFile(filename)
-	d = Decompress(d)
-	store := DecodeToStore(d)
-	restoreStore(store)
-	return len(ITEMS), nil
-}
-
-func loadAsJsonZipped(filename string) (int, error) {
-	fi, err := os.Open(filename)
+	payload, _, err := ReadSnapshotFile(filename)
 	if err != nil {
-		_, err2 := os.Getwd()
-		if err2 != nil {
-			return 0, err2
-		}
 		return 0, err
 	}
-	defer fi.Close()
-
-	fz, err := gzip.NewReader(fi)
+	store, err := DecodeToStore(Decompress(payload))
 	if err != nil {
 		return 0, err
 	}
-	defer fz.Close()
-
-	s, err := ioutil.ReadAll(fz)
+	restoreStore(store)
+	return len(ITEMS), nil
+}
 
+func loadAsJsonZipped(filename string) (int, error) {
+	payload, _, err := ReadSnapshotFile(filename)
 	if err != nil {
 		return 0, err
 	}
 
-	store := makeStore()
-	json.Unmarshal(s, &store)
+	var store Store
+	if err := json.Unmarshal(Decompress(payload), &store); err != nil {
+		return 0, err
+	}
 	restoreStore(store)
-	// GC friendly
-	s = nil
 	return len(ITEMS), nil
 }
 
@@ -218,6 +256,10 @@ func loadAtStart(storagename string, filename string, indexed bool) {
 	start := time.Now()
 	itemsAdded, err := retrievefunc(filename)
 	if err != nil {
+		var corrupt *ErrCorruptSnapshot
+		if errors.As(err, &corrupt) {
+			log.Fatal(fmt.Sprintf("snapshot %s failed integrity check: %s", filename, corrupt))
+		}
 		log.Fatal(fmt.Sprintf("could not open %s reason %s", filename, err))
 	}
 
@@ -25,6 +25,9 @@ func ItemChanWorker(itemChan ItemsChannel) {
 	for items := range itemChan {
 		for _, itm := range items {
 			if itm != nil {
+				if _, err := walInstance.Append(0, *itm); err != nil {
+					log.Println("wal append failed", err)
+				}
 				smallItem := itm.Shrink(label)
 				smallItem.StoreBitArrayColumns()
 				ITEMS = append(ITEMS, &smallItem)
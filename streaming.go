@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// streamMeta is encoded once at the start of a streaming snapshot, ahead
+// of the items themselves, so the loader knows how many item values to
+// decode and can restore the maps before indexing starts.
+type streamMeta struct {
+	Maps  ModelMaps
+	Seq   uint64
+	Count int
+}
+
+func codecName(id uint8) string {
+	switch id {
+	case codecGzip:
+		return "gzip"
+	case codecZstd:
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+type countingCRCWriter struct {
+	w   io.Writer
+	n   int64
+	crc hash.Hash32
+}
+
+func (c *countingCRCWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+type countingCRCReader struct {
+	r   io.Reader
+	n   int64
+	crc hash.Hash32
+}
+
+func (c *countingCRCReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.n += int64(n)
+		c.crc.Write(p[:n])
+	}
+	return n, err
+}
+
+// encodeStreamPayload gob-encodes Maps/Seq/Count once, then each item in
+// ITEMS, through enc. Shared by the on-disk streaming snapshot and the
+// replication full-sync path; callers that keep talking on the same
+// stream afterwards (replication) must reuse this same *gob.Encoder,
+// since the other end keeps reading with a single *gob.Decoder (see
+// decodeStreamPayload), which rejects type definitions that a fresh
+// Encoder would send again.
+func encodeStreamPayload(enc *gob.Encoder) (uint64, error) {
+	seq := walInstance.Seq()
+	meta := streamMeta{Maps: CreateMapstore(), Seq: seq, Count: len(ITEMS)}
+	if err := enc.Encode(meta); err != nil {
+		return 0, err
+	}
+	for _, itm := range ITEMS {
+		if err := enc.Encode(*itm); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+// decodeStreamPayload is the mirror of encodeStreamPayload: it decodes
+// Maps/Seq/Count then each item via dec, indexing as it arrives, the same
+// way ItemChanWorker indexes a live write. dec must be reused for
+// whatever comes next on the same stream: encoding/gob's Decoder buffers
+// ahead of what a single Decode call needs, so swapping in a second
+// Decoder over the same underlying reader can silently drop bytes.
+func decodeStreamPayload(dec *gob.Decoder) (streamMeta, error) {
+	var meta streamMeta
+	if err := dec.Decode(&meta); err != nil {
+		return meta, fmt.Errorf("decode stream meta: %w", err)
+	}
+	LoadMapstore(meta.Maps)
+
+	ITEMS = make(Items, 0, meta.Count)
+	for i := 0; i < meta.Count; i++ {
+		var itm Item
+		if err := dec.Decode(&itm); err != nil {
+			return meta, fmt.Errorf("decode item %d: %w", i, err)
+		}
+		itm.StoreBitArrayColumns()
+		ITEMS = append(ITEMS, &itm)
+		itm.GeoIndex(i)
+	}
+	return meta, nil
+}
+
+// saveStreaming encodes Maps once, then ITEMS one at a time straight onto
+// a (possibly compressing) file writer, so peak memory is O(one item)
+// instead of the whole store living in a bytes.Buffer first. The header
+// is written as a placeholder, patched with the real length/CRC once the
+// payload size is known, then the file is synced and swapped in.
+func saveStreaming(filename string, codecId uint8) (int64, error) {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(make([]byte, snapshotHeaderSize)); err != nil {
+		return 0, err
+	}
+
+	counter := &countingCRCWriter{w: f, crc: crc32.New(crc32cTable)}
+	var payloadWriter io.Writer = counter
+	var codecWriter io.WriteCloser
+	if name := codecName(codecId); name != "" {
+		codecWriter, err = CODECS[name].NewWriter(counter)
+		if err != nil {
+			return 0, err
+		}
+		payloadWriter = codecWriter
+	}
+
+	seq, err := encodeStreamPayload(gob.NewEncoder(payloadWriter))
+	if err != nil {
+		return 0, err
+	}
+
+	if codecWriter != nil {
+		if err := codecWriter.Close(); err != nil {
+			return 0, err
+		}
+	}
+
+	header := make([]byte, snapshotHeaderSize)
+	copy(header[0:4], snapshotMagic[:])
+	binary.BigEndian.PutUint16(header[4:6], snapshotVersion)
+	header[6] = codecId
+	binary.BigEndian.PutUint32(header[7:11], 0) // flags, reserved
+	binary.BigEndian.PutUint64(header[11:19], uint64(counter.n))
+	binary.BigEndian.PutUint32(header[19:23], counter.crc.Sum32())
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(header); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	f.Close()
+
+	if _, err := os.Stat(filename); err == nil {
+		os.Rename(filename, filename+".bak")
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return 0, err
+	}
+
+	finishSnapshot(Store{Seq: seq})
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// loadStreaming loads filename, falling back to filename.bak (written by
+// saveStreaming before the new file was swapped in) if the primary file is
+// missing or fails verification, the same way ReadSnapshotFile does for the
+// non-streaming formats.
+func loadStreaming(filename string) (int, error) {
+	n, err := loadStreamingFile(filename)
+	if err == nil {
+		return n, nil
+	}
+
+	bak := filename + ".bak"
+	if _, statErr := os.Stat(bak); statErr == nil {
+		fmt.Println("primary snapshot failed verification, falling back to", bak, "reason:", err)
+		return loadStreamingFile(bak)
+	}
+	return n, err
+}
+
+// loadStreamingFile mirrors ItemChanWorker: it decodes Maps/Seq once, then
+// decodes items one at a time straight off the (possibly decompressing)
+// file reader, indexing each as it arrives instead of reading the whole
+// file into memory first. The length/CRC recorded in the header can only
+// be verified once the whole stream has been consumed, so a corrupt tail
+// is still detected, just after ITEMS has already been populated — callers
+// must treat a returned *ErrCorruptSnapshot as "ITEMS may be garbage", not
+// just "the load didn't happen".
+func loadStreamingFile(filename string) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, &ErrCorruptSnapshot{Filename: filename, Reason: "file shorter than header"}
+	}
+	if string(header[0:4]) != string(snapshotMagic[:]) {
+		return 0, &ErrCorruptSnapshot{Filename: filename, Reason: "bad magic"}
+	}
+	if version := binary.BigEndian.Uint16(header[4:6]); version != snapshotVersion {
+		return 0, &ErrCorruptSnapshot{Filename: filename, Reason: fmt.Sprintf("unsupported version %d", version)}
+	}
+	codecId := header[6]
+	wantLen := binary.BigEndian.Uint64(header[11:19])
+	wantCRC := binary.BigEndian.Uint32(header[19:23])
+
+	counter := &countingCRCReader{r: f, crc: crc32.New(crc32cTable)}
+	var payloadReader io.Reader = counter
+	var codecReader io.ReadCloser
+	if name := codecName(codecId); name != "" {
+		codecReader, err = CODECS[name].NewReader(counter)
+		if err != nil {
+			return 0, err
+		}
+		payloadReader = codecReader
+	}
+
+	meta, err := decodeStreamPayload(gob.NewDecoder(payloadReader))
+	if err != nil {
+		return len(ITEMS), err
+	}
+	if codecReader != nil {
+		codecReader.Close()
+	}
+	// The decoder can stop before the end of the file (e.g. a compressed
+	// stream's trailer), so read the rest through counter before checking.
+	if _, err := io.Copy(ioutil.Discard, counter); err != nil {
+		return len(ITEMS), err
+	}
+
+	if counter.n != int64(wantLen) || counter.crc.Sum32() != wantCRC {
+		return len(ITEMS), &ErrCorruptSnapshot{Filename: filename, Reason: "length/CRC mismatch after decode"}
+	}
+
+	if err := walInstance.Replay(meta.Seq, applyWalRecord); err != nil {
+		fmt.Println("Unable to replay WAL", err)
+	}
+	return len(ITEMS), nil
+}
+
+func saveAsBytesStreaming(filename string) (int64, error) {
+	return saveStreaming(filename, codecNone)
+}
+
+func saveAsBytesStreamingCompressed(filename string) (int64, error) {
+	return saveStreaming(filename, codecGzip)
+}
+
+func loadAsBytesStreaming(filename string) (int, error) {
+	return loadStreaming(filename)
+}
+
+func loadAsBytesStreamingCompressed(filename string) (int, error) {
+	return loadStreaming(filename)
+}
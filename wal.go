@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// crc32cTable is the Castagnoli polynomial, used for WAL record framing.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+const walSegmentPrefix = "wal-"
+const walSegmentSuffix = ".log"
+const defaultWalSegmentMax = 64 * 1024 * 1024 // 64MB
+
+// WalRecord is one durable write. Replaying it feeds Item back through the
+// same shrink/index pipeline ItemChanWorker uses for live writes.
+type WalRecord struct {
+	Seq       uint64
+	Timestamp int64
+	TypeId    int
+	Item      ItemIn
+}
+
+// WAL is an append-only, segmented write-ahead log. Every record is framed
+// as 4-byte length + 4-byte CRC32C(payload) + payload, so a torn write at
+// the tail of a segment is detected and truncated on reopen instead of
+// corrupting the rest of the log.
+type WAL struct {
+	mu         sync.Mutex
+	dir        string
+	segmentMax int64
+	syncEvery  bool
+
+	file    *os.File
+	segNum  uint64
+	size    int64
+	nextSeq uint64
+
+	notifyMu sync.Mutex
+	notifyCh chan struct{}
+}
+
+var walInstance *WAL
+
+func init() {
+	walInstance = newWAL(walDirFromEnv(), walSegmentMaxFromEnv(), walSyncEveryFromEnv())
+	if err := walInstance.open(); err != nil {
+		fmt.Println("Unable to open WAL", err)
+	}
+}
+
+func walDirFromEnv() string {
+	dir := os.Getenv("WAL_DIR")
+	if dir == "" {
+		dir = "."
+	}
+	return dir
+}
+
+func walSegmentMaxFromEnv() int64 {
+	if v := os.Getenv("WAL_SEGMENT_MB"); v != "" {
+		if mb, err := strconv.ParseInt(v, 10, 64); err == nil && mb > 0 {
+			return mb * 1024 * 1024
+		}
+	}
+	return defaultWalSegmentMax
+}
+
+// walSyncEveryFromEnv picks the durability mode: WAL_SYNC=always fsyncs
+// every record, anything else fsyncs only on segment roll so bulk loads
+// aren't bottlenecked on disk latency.
+func walSyncEveryFromEnv() bool {
+	return os.Getenv("WAL_SYNC") == "always"
+}
+
+func newWAL(dir string, segmentMax int64, syncEvery bool) *WAL {
+	return &WAL{dir: dir, segmentMax: segmentMax, syncEvery: syncEvery, notifyCh: make(chan struct{})}
+}
+
+// NotifyChan returns the channel that's closed the next time a record is
+// appended. Callers should grab this before scanning for new records, not
+// after, so an append that happens mid-scan still wakes a subsequent wait.
+func (w *WAL) NotifyChan() <-chan struct{} {
+	w.notifyMu.Lock()
+	defer w.notifyMu.Unlock()
+	return w.notifyCh
+}
+
+func (w *WAL) broadcastAppend() {
+	w.notifyMu.Lock()
+	close(w.notifyCh)
+	w.notifyCh = make(chan struct{})
+	w.notifyMu.Unlock()
+}
+
+func walSegmentName(segNum uint64) string {
+	return fmt.Sprintf("%s%06d%s", walSegmentPrefix, segNum, walSegmentSuffix)
+}
+
+// walSegments returns the WAL's segment numbers, sorted ascending.
+func walSegments(dir string) ([]uint64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var segs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		numStr := strings.TrimSuffix(strings.TrimPrefix(name, walSegmentPrefix), walSegmentSuffix)
+		num, err := strconv.ParseUint(numStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, num)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+// open finds the newest segment (creating the first one if none exist) and
+// picks up the sequence counter where the last process left off.
+func (w *WAL) open() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segs, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	lastSeq, _, err := w.scanSegments(segs, 0, nil)
+	if err != nil {
+		return err
+	}
+	w.nextSeq = lastSeq + 1
+
+	segNum := uint64(0)
+	if len(segs) > 0 {
+		segNum = segs[len(segs)-1]
+	}
+	return w.openSegment(segNum)
+}
+
+func (w *WAL) openSegment(segNum uint64) error {
+	if w.file != nil {
+		w.file.Close()
+	}
+	path := filepath.Join(w.dir, walSegmentName(segNum))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	validLen, err := validFrameLength(path)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(validLen); err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.segNum = segNum
+	w.size = validLen
+	return nil
+}
+
+// validFrameLength scans path frame-by-frame and returns the byte offset
+// just past the last well-formed frame. A crash mid-append can leave a
+// torn write (a partial length/CRC header or payload) at the tail; without
+// truncating it away first, resuming appends there would bury that
+// garbage under new, otherwise-valid records, and readFrames' permanent
+// stop-at-first-bad-frame behavior would make every record after it
+// invisible to Replay forever.
+func validFrameLength(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	var offset int64
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			return offset, nil
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		wantCRC := binary.BigEndian.Uint32(header[4:8])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			return offset, nil
+		}
+		if crc32.Checksum(payload, crc32cTable) != wantCRC {
+			return offset, nil
+		}
+
+		offset += 8 + int64(length)
+	}
+}
+
+// writeFrameLocked frames and appends rec to the current segment, rolling
+// to a new segment first if the current one is past segmentMax. Caller
+// must hold w.mu.
+func (w *WAL) writeFrameLocked(rec WalRecord) error {
+	if w.file == nil {
+		return fmt.Errorf("wal: not open")
+	}
+
+	if w.size >= w.segmentMax {
+		if !w.syncEvery {
+			if err := w.file.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := w.openSegment(w.segNum + 1); err != nil {
+			return err
+		}
+	}
+
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return err
+	}
+	payload := buf.Bytes()
+
+	frame := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crc32cTable))
+	copy(frame[8:], payload)
+
+	n, err := w.file.Write(frame)
+	if err != nil {
+		return err
+	}
+	w.size += int64(n)
+
+	if w.syncEvery {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// Append writes one record to the tail of the current segment, allocating
+// the next local sequence number for it.
+func (w *WAL) Append(typeId int, item ItemIn) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seq := w.nextSeq
+	rec := WalRecord{Seq: seq, Timestamp: time.Now().UnixNano(), TypeId: typeId, Item: item}
+	if err := w.writeFrameLocked(rec); err != nil {
+		return 0, err
+	}
+
+	w.nextSeq++
+	w.broadcastAppend()
+	return seq, nil
+}
+
+// AppendRecord writes a record whose Seq was already assigned elsewhere,
+// preserving it instead of allocating a new local one. A replica uses
+// this to apply records received from a leader, so its own WAL stays in
+// the leader's sequence space and a reconnect can resume with a real
+// "SYNC <lastSeq>" instead of forcing a full sync every time.
+func (w *WAL) AppendRecord(rec WalRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.writeFrameLocked(rec); err != nil {
+		return err
+	}
+
+	if rec.Seq >= w.nextSeq {
+		w.nextSeq = rec.Seq + 1
+	}
+	w.broadcastAppend()
+	return nil
+}
+
+// Seq returns the last sequence number assigned.
+func (w *WAL) Seq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.nextSeq == 0 {
+		return 0
+	}
+	return w.nextSeq - 1
+}
+
+// AdvanceSeq records that seq is now known to be applied without writing a
+// WAL frame for it, the way a full sync does: the snapshot already covers
+// everything up to seq, so there's nothing left to append, only the
+// counter to catch up so Seq()/a future SYNC handshake reflect reality.
+func (w *WAL) AdvanceSeq(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq >= w.nextSeq {
+		w.nextSeq = seq + 1
+	}
+}
+
+// readFrames reads every well-formed record from r, stopping (without
+// error) at the first short read or CRC mismatch, since that marks a torn
+// write at the tail of the segment that a crash interrupted mid-append.
+func readFrames(r io.Reader, fn func(WalRecord) error) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		wantCRC := binary.BigEndian.Uint32(header[4:8])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil
+		}
+		if crc32.Checksum(payload, crc32cTable) != wantCRC {
+			return nil
+		}
+
+		var rec WalRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+			return nil
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// scanSegments walks segs in order, calling handler (if non-nil) for every
+// record with Seq > afterSeq, and returns the highest Seq seen plus each
+// segment's highest Seq, keyed by segment number (what Prune compares
+// against its cutoff).
+func (w *WAL) scanSegments(segs []uint64, afterSeq uint64, handler func(WalRecord) error) (uint64, map[uint64]uint64, error) {
+	var maxSeq uint64
+	segMax := make(map[uint64]uint64)
+
+	for _, segNum := range segs {
+		path := filepath.Join(w.dir, walSegmentName(segNum))
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return maxSeq, segMax, err
+		}
+
+		err = readFrames(f, func(rec WalRecord) error {
+			if rec.Seq > maxSeq {
+				maxSeq = rec.Seq
+			}
+			if rec.Seq > segMax[segNum] {
+				segMax[segNum] = rec.Seq
+			}
+			if handler != nil && rec.Seq > afterSeq {
+				return handler(rec)
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return maxSeq, segMax, err
+		}
+	}
+	return maxSeq, segMax, nil
+}
+
+// Replay feeds every record with Seq > afterSeq (i.e. written after the
+// last snapshot) through handler, in segment then on-disk order.
+func (w *WAL) Replay(afterSeq uint64, handler func(WalRecord) error) error {
+	w.mu.Lock()
+	dir := w.dir
+	w.mu.Unlock()
+
+	segs, err := walSegments(dir)
+	if err != nil {
+		return err
+	}
+	_, _, err = w.scanSegments(segs, afterSeq, handler)
+	return err
+}
+
+// Prune deletes every segment whose records are all Seq <= upToSeq, i.e.
+// fully covered by a snapshot taken at upToSeq. The current (still being
+// written) segment is never removed.
+func (w *WAL) Prune(upToSeq uint64) error {
+	w.mu.Lock()
+	currentSeg := w.segNum
+	dir := w.dir
+	w.mu.Unlock()
+
+	segs, err := walSegments(dir)
+	if err != nil {
+		return err
+	}
+	_, segMax, err := w.scanSegments(segs, 0, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, segNum := range segs {
+		if segNum == currentSeg {
+			continue
+		}
+		if segMax[segNum] <= upToSeq {
+			os.Remove(filepath.Join(dir, walSegmentName(segNum)))
+		}
+	}
+	return nil
+}
+
+// OldestSeq returns the lowest sequence number still retained by the WAL
+// (the first record of its oldest segment), or 0 if the WAL is empty.
+// A replica asking to resume from a seq older than this has to fall back
+// to a full sync since the records in between have been pruned.
+func (w *WAL) OldestSeq() (uint64, error) {
+	w.mu.Lock()
+	dir := w.dir
+	w.mu.Unlock()
+
+	segs, err := walSegments(dir)
+	if err != nil || len(segs) == 0 {
+		return 0, err
+	}
+
+	f, err := os.Open(filepath.Join(dir, walSegmentName(segs[0])))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var oldest uint64
+	err = readFrames(f, func(rec WalRecord) error {
+		oldest = rec.Seq
+		return errStopScan
+	})
+	if err != nil && err != errStopScan {
+		return 0, err
+	}
+	return oldest, nil
+}
+
+// errStopScan lets a record handler stop readFrames early without that
+// being treated as a real failure.
+var errStopScan = fmt.Errorf("wal: stop scan")
+
+// applyWalRecord runs a replayed WAL record through the same shrink/index
+// steps ItemChanWorker applies to a live write.
+func applyWalRecord(rec WalRecord) error {
+	label := len(ITEMS)
+	smallItem := rec.Item.Shrink(label)
+	smallItem.StoreBitArrayColumns()
+	ITEMS = append(ITEMS, &smallItem)
+	smallItem.GeoIndex(label)
+	return nil
+}